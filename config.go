@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sync"
@@ -21,6 +24,18 @@ const (
 	userFilterID         = 0         // special filter ID, always 0
 )
 
+// Filter list formats supported by filter.normalize(). Everything except "adguard" is
+// converted into AdGuard blocking syntax before the filter plugin sees it, so the
+// generated Corefile only ever has to deal with one rule format.
+const (
+	filterFormatAdGuard = "adguard"
+	filterFormatHosts   = "hosts"
+	filterFormatRPZ     = "rpz"
+	filterFormatAuto    = "auto"
+
+	filterFormatSniffLines = 10 // number of non-comment lines inspected to auto-detect a format
+)
+
 // Just a counter that we use for incrementing the filter ID
 var nextFilterID int64 = time.Now().Unix()
 
@@ -48,23 +63,28 @@ type configuration struct {
 type coreDNSConfig struct {
 	binaryFile          string
 	coreFile            string
-	Filters             []filter `yaml:"-"`
-	Port                int      `yaml:"port"`
-	ProtectionEnabled   bool     `yaml:"protection_enabled"`
-	FilteringEnabled    bool     `yaml:"filtering_enabled"`
-	SafeBrowsingEnabled bool     `yaml:"safebrowsing_enabled"`
-	SafeSearchEnabled   bool     `yaml:"safesearch_enabled"`
-	ParentalEnabled     bool     `yaml:"parental_enabled"`
-	ParentalSensitivity int      `yaml:"parental_sensitivity"`
-	BlockedResponseTTL  int      `yaml:"blocked_response_ttl"`
-	QueryLogEnabled     bool     `yaml:"querylog_enabled"`
-	Ratelimit           int      `yaml:"ratelimit"`
-	RefuseAny           bool     `yaml:"refuse_any"`
-	Pprof               string   `yaml:"-"`
-	Cache               string   `yaml:"-"`
-	Prometheus          string   `yaml:"-"`
-	BootstrapDNS        string   `yaml:"bootstrap_dns"`
-	UpstreamDNS         []string `yaml:"upstream_dns"`
+	Filters             []corefileFilter `yaml:"-"`
+	Port                int              `yaml:"port"`
+	TLSPort             int              `yaml:"tls_port"`   // port to serve DNS-over-TLS on, 0 to disable
+	HTTPSPort           int              `yaml:"https_port"` // port to serve DNS-over-HTTPS on, 0 to disable
+	TLSCertPath         string           `yaml:"tls_cert"`   // path to the certificate used for DoT/DoH
+	TLSKeyPath          string           `yaml:"tls_key"`    // path to the private key used for DoT/DoH
+	DohPath             string           `yaml:"doh_path"`   // URL path DoH is served on, e.g. "/dns-query"
+	ProtectionEnabled   bool             `yaml:"protection_enabled"`
+	FilteringEnabled    bool             `yaml:"filtering_enabled"`
+	SafeBrowsingEnabled bool             `yaml:"safebrowsing_enabled"`
+	SafeSearchEnabled   bool             `yaml:"safesearch_enabled"`
+	ParentalEnabled     bool             `yaml:"parental_enabled"`
+	ParentalSensitivity int              `yaml:"parental_sensitivity"`
+	BlockedResponseTTL  int              `yaml:"blocked_response_ttl"`
+	QueryLogEnabled     bool             `yaml:"querylog_enabled"`
+	Ratelimit           int              `yaml:"ratelimit"`
+	RefuseAny           bool             `yaml:"refuse_any"`
+	Pprof               string           `yaml:"-"`
+	Cache               string           `yaml:"-"`
+	Prometheus          string           `yaml:"-"`
+	BootstrapDNS        string           `yaml:"bootstrap_dns"`
+	UpstreamDNS         []string         `yaml:"upstream_dns"`
 }
 
 // field ordering is important -- yaml fields will mirror ordering from here
@@ -72,11 +92,14 @@ type filter struct {
 	Enabled     bool      `json:"enabled"`
 	URL         string    `json:"url"`
 	Name        string    `json:"name" yaml:"name"`
+	Format      string    `json:"format" yaml:"format,omitempty"` // "adguard" | "hosts" | "rpz" | "auto"
 	RulesCount  int       `json:"rulesCount" yaml:"-"`
 	LastUpdated time.Time `json:"lastUpdated,omitempty" yaml:"last_updated,omitempty"`
 	ID          int64     // auto-assigned when filter is added (see nextFilterID)
 
 	Contents []byte `json:"-" yaml:"-"` // not in yaml or json
+
+	normalized bool // true once normalize() has converted Contents; cleared by setContents
 }
 
 var defaultDNS = []string{"tls://1.1.1.1", "tls://1.0.0.1"}
@@ -103,10 +126,10 @@ var config = configuration{
 		Prometheus:          "prometheus :9153",
 	},
 	Filters: []filter{
-		{ID: 1, Enabled: true, URL: "https://adguardteam.github.io/AdGuardSDNSFilter/Filters/filter.txt", Name: "AdGuard Simplified Domain Names filter"},
-		{ID: 2, Enabled: false, URL: "https://adaway.org/hosts.txt", Name: "AdAway"},
-		{ID: 3, Enabled: false, URL: "https://hosts-file.net/ad_servers.txt", Name: "hpHosts - Ad and Tracking servers only"},
-		{ID: 4, Enabled: false, URL: "http://www.malwaredomainlist.com/hostslist/hosts.txt", Name: "MalwareDomainList.com Hosts List"},
+		{ID: 1, Enabled: true, URL: "https://adguardteam.github.io/AdGuardSDNSFilter/Filters/filter.txt", Name: "AdGuard Simplified Domain Names filter", Format: filterFormatAdGuard},
+		{ID: 2, Enabled: false, URL: "https://adaway.org/hosts.txt", Name: "AdAway", Format: filterFormatHosts},
+		{ID: 3, Enabled: false, URL: "https://hosts-file.net/ad_servers.txt", Name: "hpHosts - Ad and Tracking servers only", Format: filterFormatHosts},
+		{ID: 4, Enabled: false, URL: "http://www.malwaredomainlist.com/hostslist/hosts.txt", Name: "MalwareDomainList.com Hosts List", Format: filterFormatHosts},
 	},
 }
 
@@ -167,70 +190,332 @@ func parseConfig() error {
 
 	updateUniqueFilterID(config.Filters)
 
+	if err = checkCoreDNSTLSConfig(config.CoreDNS); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// Saves configuration to the YAML file and also saves the user filter contents to a file
-func (c *configuration) write() error {
-	c.Lock()
-	defer c.Unlock()
-	configFile := filepath.Join(config.ourBinaryDir, config.ourConfigFilename)
-	log.Printf("Writing YAML file: %s", configFile)
-	yamlText, err := yaml.Marshal(&config)
-	if err != nil {
-		log.Printf("Couldn't generate YAML file: %s", err)
+// checkCoreDNSTLSConfig makes sure that if DoT and/or DoH listeners are enabled, the
+// configured certificate and key actually exist and are readable -- we'd rather fail
+// here than write out a Corefile that CoreDNS can't start with.
+func checkCoreDNSTLSConfig(cfg coreDNSConfig) error {
+	if cfg.TLSPort == 0 && cfg.HTTPSPort == 0 {
+		return nil
+	}
+
+	if cfg.TLSCertPath == "" || cfg.TLSKeyPath == "" {
+		err := fmt.Errorf("tls_cert and tls_key must be set when tls_port or https_port is enabled")
+		log.Printf("%s", err)
 		return err
 	}
-	err = safeWriteFile(configFile, yamlText)
-	if err != nil {
-		log.Printf("Couldn't save YAML config: %s", err)
+
+	if err := checkReadableFile(cfg.TLSCertPath); err != nil {
+		log.Printf("Couldn't read tls_cert: %s", err)
 		return err
 	}
 
-	userFilter := userFilter()
-	err = userFilter.save()
-	if err != nil {
-		log.Printf("Couldn't save the user filter: %s", err)
+	if err := checkReadableFile(cfg.TLSKeyPath); err != nil {
+		log.Printf("Couldn't read tls_key: %s", err)
 		return err
 	}
 
 	return nil
 }
 
-// --------------
-// coredns config
-// --------------
-func writeCoreDNSConfig() error {
-	coreFile := filepath.Join(config.ourBinaryDir, config.CoreDNS.coreFile)
-	log.Printf("Writing DNS config: %s", coreFile)
-	configText, err := generateCoreDNSConfigText()
+// checkReadableFile makes sure the file at path exists and can be opened for reading
+func checkReadableFile(path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Printf("Couldn't generate DNS config: %s", err)
 		return err
 	}
-	err = safeWriteFile(coreFile, []byte(configText))
-	if err != nil {
-		log.Printf("Couldn't save DNS config: %s", err)
-		return err
+	return f.Close()
+}
+
+// normalizeFilters converts every loaded filter's Contents into canonical AdGuard
+// syntax via filter.normalize(), so that by the time the YAML is marshaled and the
+// Corefile is (re)generated, Format reflects what was actually detected and RulesCount
+// reflects the normalized rule list rather than the raw downloaded one.
+func (c *configuration) normalizeFilters() {
+	for i := range c.Filters {
+		if len(c.Filters[i].Contents) == 0 {
+			continue
+		}
+		c.Filters[i].normalize()
 	}
-	return nil
 }
 
+// applyTimeout bounds how long writeAllConfigs will let Apply's CoreDNS-validation
+// subprocess run before giving up. This keeps Apply from blocking its caller
+// indefinitely if the coredns binary ever fails to exit on its own.
+const applyTimeout = 10 * time.Second
+
+// writeAllConfigs writes the YAML config and the Corefile as a single atomic
+// transaction. It's kept around as a convenience wrapper around Apply for callers
+// that don't have a context of their own (e.g. our own startup code).
 func writeAllConfigs() error {
-	err := config.write()
-	if err != nil {
-		log.Printf("Couldn't write our config: %s", err)
+	ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+	defer cancel()
+	return config.Apply(ctx)
+}
+
+// configSnapshot holds the on-disk bytes of the YAML config, the Corefile and the user
+// filter so Apply can restore them if a rename partway through the commit fails.
+type configSnapshot struct {
+	yaml       []byte
+	coreFile   []byte
+	userFilter []byte
+}
+
+// readFileIfExists reads path, treating a missing file as "no snapshot" rather than
+// an error -- this is normal on first run, before either file has ever been written.
+func readFileIfExists(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// restore writes the snapshotted bytes back to configFile, coreFile and userFilterFile,
+// undoing a partially-applied transaction.
+func (s *configSnapshot) restore(configFile, coreFile, userFilterFile string) error {
+	if s.yaml != nil {
+		if err := safeWriteFile(configFile, s.yaml); err != nil {
+			return err
+		}
+	}
+	if s.coreFile != nil {
+		if err := safeWriteFile(coreFile, s.coreFile); err != nil {
+			return err
+		}
+	}
+	if s.userFilter != nil {
+		if err := safeWriteFile(userFilterFile, s.userFilter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeConfigSchema migrates a configuration loaded from an older schema version to
+// currentSchemaVersion. Add a case here (and bump currentSchemaVersion) whenever the
+// YAML layout changes in a way that needs translating old values into new ones.
+func upgradeConfigSchema(c *configuration) error {
+	switch c.SchemaVersion {
+	case 0:
+		// schema 0 and 1 are wire-compatible, nothing to migrate yet
+	}
+	c.SchemaVersion = currentSchemaVersion
+	return nil
+}
+
+// Throwaway listen ports used only to dry-run a candidate Corefile -- upstream CoreDNS
+// has no dedicated "just check the syntax" flag, so validateCoreDNSConfig instead
+// starts a short-lived instance bound to these instead of the real ports, to avoid
+// fighting the already-running daemon for ports 53/853/443.
+const (
+	coreDNSValidatePort      = 15053
+	coreDNSValidateTLSPort   = 15853
+	coreDNSValidateHTTPSPort = 15443
+
+	coreDNSValidateGracePeriod = 2 * time.Second
+)
+
+// generateValidationCoreDNSConfigText renders cfg the same way generateCoreDNSConfigText
+// does, but rebound to coreDNSValidate* ports so the dry run in validateCoreDNSConfig
+// doesn't collide with the real listeners, and pointing the user filter's "filter"
+// directive at userFilterPath instead of its real on-disk location -- Apply calls this
+// with the path of the staged *.new user filter, so the dry run actually exercises the
+// candidate rules instead of whatever's currently committed.
+func generateValidationCoreDNSConfigText(cfg coreDNSConfig, userFilterPath string) (string, error) {
+	cfg.Port = coreDNSValidatePort
+	if cfg.TLSPort != 0 {
+		cfg.TLSPort = coreDNSValidateTLSPort
+	}
+	if cfg.HTTPSPort != 0 {
+		cfg.HTTPSPort = coreDNSValidateHTTPSPort
+	}
+	// the real daemon is already bound to these if it's running; the throwaway
+	// validation instance doesn't need metrics/profiling, so drop them rather than
+	// fight over the same address
+	cfg.Prometheus = ""
+	cfg.Pprof = ""
+	return renderCoreDNSConfigText(cfg, userFilterPath)
+}
+
+// validateCoreDNSConfig starts the coredns binary against coreFile and watches whether
+// it exits on its own within coreDNSValidateGracePeriod. CoreDNS parses the Corefile
+// and binds its listeners at startup, exiting immediately with a non-zero status on a
+// syntax or bind error; if it's still running once the grace period elapses, the
+// Corefile loaded cleanly, so the throwaway instance is killed and success is reported.
+// This deliberately doesn't rely on a "-validate" flag, since upstream CoreDNS doesn't
+// have one.
+func validateCoreDNSConfig(ctx context.Context, coreFile string) error {
+	binaryFile := filepath.Join(config.ourBinaryDir, config.CoreDNS.binaryFile)
+	cmd := exec.CommandContext(ctx, binaryFile, "-conf", coreFile)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("couldn't start coredns to validate %s: %s", coreFile, err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- cmd.Wait() }()
+
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			return fmt.Errorf("coredns rejected the generated Corefile: %s: %s", err, out.String())
+		}
+		// exited cleanly on its own -- unusual for a server that's supposed to keep
+		// running, but not a sign the Corefile itself is broken
+		return nil
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		<-waitErr
+		return fmt.Errorf("timed out validating Corefile: %s", ctx.Err())
+	case <-time.After(coreDNSValidateGracePeriod):
+		// still running after the grace period: the Corefile parsed and the
+		// listeners came up cleanly, so stop the throwaway instance and call it good
+		_ = cmd.Process.Kill()
+		<-waitErr
+		return nil
+	}
+}
+
+// Apply atomically writes the YAML config, the generated Corefile and the user filter:
+// it snapshots the current on-disk state, writes all three as *.new files plus a
+// throwaway-port variant of the Corefile that points at the staged user filter, dry-runs
+// that variant through validateCoreDNSConfig, and only then renames the real *.new files
+// into place. Validating the staged user filter rather than whatever's currently on disk
+// is what lets a bad UserRules entry actually block the commit instead of slipping
+// through because the dry run checked stale content. If validation fails, nothing is
+// renamed and the previous on-disk files stay in place; if a rename can't complete, the
+// previous on-disk state is restored from the snapshot. Either way the returned error is
+// a plain error value whose message names the step that failed, not a distinct error
+// type, so HTTP handlers can surface that message to the UI instead of leaving a running
+// daemon out of sync with the config on disk.
+//
+// Running the validation subprocess can take multiple seconds; c.Lock() is only held
+// for the parts that read or change c (normalizing filters, marshaling the YAML and
+// rendering both Corefiles, and the final renames), not for the file writes or the
+// subprocess, so a settings save doesn't stall every other reader of config for the
+// duration of a CoreDNS dry run. The caller's ctx still bounds how long the validation subprocess may
+// run, so a hung or misbehaving coredns binary can't block the commit forever.
+func (c *configuration) Apply(ctx context.Context) error {
+	c.Lock()
+	if c.SchemaVersion < currentSchemaVersion {
+		if err := upgradeConfigSchema(c); err != nil {
+			c.Unlock()
+			return fmt.Errorf("couldn't upgrade config schema: %s", err)
+		}
+	}
+
+	if err := checkCoreDNSTLSConfig(c.CoreDNS); err != nil {
+		c.Unlock()
 		return err
 	}
-	err = writeCoreDNSConfig()
+
+	c.normalizeFilters()
+
+	yamlText, err := yaml.Marshal(c)
 	if err != nil {
-		log.Printf("Couldn't write DNS config: %s", err)
-		return err
+		c.Unlock()
+		return fmt.Errorf("couldn't generate YAML file: %s", err)
+	}
+	coreCfg := c.CoreDNS
+	newUserFilter := userFilter()
+
+	configText, err := renderCoreDNSConfigText(coreCfg, "")
+	if err != nil {
+		c.Unlock()
+		return fmt.Errorf("couldn't generate DNS config: %s", err)
+	}
+	validationText, err := generateValidationCoreDNSConfigText(coreCfg, newUserFilter.Path()+".new")
+	if err != nil {
+		c.Unlock()
+		return fmt.Errorf("couldn't generate DNS config for validation: %s", err)
 	}
+	c.Unlock()
+
+	configFile := filepath.Join(c.ourBinaryDir, c.ourConfigFilename)
+	coreFile := filepath.Join(c.ourBinaryDir, coreCfg.coreFile)
+	userFilterFile := newUserFilter.Path()
+
+	prevYaml, err := readFileIfExists(configFile)
+	if err != nil {
+		return fmt.Errorf("couldn't snapshot %s: %s", configFile, err)
+	}
+	prevCoreFile, err := readFileIfExists(coreFile)
+	if err != nil {
+		return fmt.Errorf("couldn't snapshot %s: %s", coreFile, err)
+	}
+	prevUserFilter, err := readFileIfExists(userFilterFile)
+	if err != nil {
+		return fmt.Errorf("couldn't snapshot %s: %s", userFilterFile, err)
+	}
+	snapshot := &configSnapshot{yaml: prevYaml, coreFile: prevCoreFile, userFilter: prevUserFilter}
+
+	newConfigFile := configFile + ".new"
+	newCoreFile := coreFile + ".new"
+	newUserFilterFile := userFilterFile + ".new"
+	validateCoreFile := coreFile + ".validate"
+
+	if err = safeWriteFile(newConfigFile, yamlText); err != nil {
+		return fmt.Errorf("couldn't write %s: %s", newConfigFile, err)
+	}
+	defer os.Remove(newConfigFile)
+
+	if err = safeWriteFile(newCoreFile, []byte(configText)); err != nil {
+		return fmt.Errorf("couldn't write %s: %s", newCoreFile, err)
+	}
+	defer os.Remove(newCoreFile)
+
+	if err = safeWriteFile(newUserFilterFile, newUserFilter.Contents); err != nil {
+		return fmt.Errorf("couldn't write %s: %s", newUserFilterFile, err)
+	}
+	defer os.Remove(newUserFilterFile)
+
+	if err = safeWriteFile(validateCoreFile, []byte(validationText)); err != nil {
+		return fmt.Errorf("couldn't write %s: %s", validateCoreFile, err)
+	}
+	defer os.Remove(validateCoreFile)
+
+	if err = validateCoreDNSConfig(ctx, validateCoreFile); err != nil {
+		return fmt.Errorf("generated Corefile failed validation, keeping previous config: %s", err)
+	}
+
+	// Only the commit itself -- renaming the staged files into place -- needs c
+	// locked again; it's just a handful of renames, so this is fast.
+	c.Lock()
+	defer c.Unlock()
+
+	if err = os.Rename(newConfigFile, configFile); err != nil {
+		return fmt.Errorf("couldn't activate new YAML config: %s", err)
+	}
+	if err = os.Rename(newCoreFile, coreFile); err != nil {
+		// the YAML config already moved, so restore everything from the snapshot to
+		// keep the three files from ending up out of sync
+		if restoreErr := snapshot.restore(configFile, coreFile, userFilterFile); restoreErr != nil {
+			log.Printf("Couldn't restore previous config after a failed Apply: %s", restoreErr)
+		}
+		return fmt.Errorf("couldn't activate new Corefile: %s", err)
+	}
+	if err = os.Rename(newUserFilterFile, userFilterFile); err != nil {
+		if restoreErr := snapshot.restore(configFile, coreFile, userFilterFile); restoreErr != nil {
+			log.Printf("Couldn't restore previous config after a failed Apply: %s", restoreErr)
+		}
+		return fmt.Errorf("couldn't activate new user filter: %s", err)
+	}
+
 	return nil
 }
 
-const coreDNSConfigTemplate = `.:{{.Port}} {
+const coreDNSConfigTemplate = `{{define "plugins"}}
 	{{if .ProtectionEnabled}}dnsfilter {
 		{{if .SafeBrowsingEnabled}}safebrowsing{{end}}
 		{{if .ParentalEnabled}}parental {{.ParentalSensitivity}}{{end}}
@@ -250,13 +535,48 @@ const coreDNSConfigTemplate = `.:{{.Port}} {
 	{{if .UpstreamDNS}}upstream {{range .UpstreamDNS}}{{.}} {{end}} { bootstrap {{.BootstrapDNS}} }{{end}}
 	{{.Cache}}
 	{{.Prometheus}}
+{{end}}.:{{.Port}} {
+	{{template "plugins" .}}
+}
+{{if .TLSPort}}tls://.:{{.TLSPort}} {
+	tls {{.TLSCertPath}} {{.TLSKeyPath}}
+	{{template "plugins" .}}
 }
+{{end}}
+{{if .HTTPSPort}}https://.:{{.HTTPSPort}} {
+	tls {{.TLSCertPath}} {{.TLSKeyPath}}
+	{{if .DohPath}}doh {{.DohPath}}{{end}}
+	{{template "plugins" .}}
+}
+{{end}}
 `
 
 var removeEmptyLines = regexp.MustCompile("([\t ]*\n)+")
 
 // generate CoreDNS config text
 func generateCoreDNSConfigText() (string, error) {
+	return renderCoreDNSConfigText(config.CoreDNS, "")
+}
+
+// corefileFilter is the per-filter data coreDNSConfigTemplate renders into a "filter"
+// directive. It exists separately from filter so that renderCoreDNSConfigText can point
+// the user filter's directive at a staged path (see userFilterPath below) without
+// touching filter.Path() or the real on-disk location the running daemon reads from.
+type corefileFilter struct {
+	ID       int64
+	Path     string
+	Enabled  bool
+	Contents []byte
+}
+
+// renderCoreDNSConfigText runs coreDNSConfigTemplate against cfg, plus the current user
+// filter and filter list. Broken out from generateCoreDNSConfigText so that
+// generateValidationCoreDNSConfigText can render the same config against throwaway listen ports
+// without touching the real CoreDNS.Port/TLSPort/HTTPSPort in use by the running daemon.
+// If userFilterPath is non-empty, it's used as the user filter's directive path instead
+// of userFilter().Path() -- Apply passes the path of a staged *.new user filter here so
+// the validation render actually points at the candidate rules being committed.
+func renderCoreDNSConfigText(cfg coreDNSConfig, userFilterPath string) (string, error) {
 	t, err := template.New("config").Parse(coreDNSConfigTemplate)
 	if err != nil {
 		log.Printf("Couldn't generate DNS config: %s", err)
@@ -264,18 +584,23 @@ func generateCoreDNSConfigText() (string, error) {
 	}
 
 	var configBytes bytes.Buffer
-	temporaryConfig := config.CoreDNS
+	temporaryConfig := cfg
 
 	// generate temporary filter list, needed to put userfilter in coredns config
-	filters := []filter{}
+	filters := []corefileFilter{}
 
 	// first of all, append the user filter
 	userFilter := userFilter()
-
-	filters = append(filters, userFilter)
+	uPath := userFilter.Path()
+	if userFilterPath != "" {
+		uPath = userFilterPath
+	}
+	filters = append(filters, corefileFilter{ID: userFilter.ID, Path: uPath, Enabled: userFilter.Enabled, Contents: userFilter.Contents})
 
 	// then go through other filters
-	filters = append(filters, config.Filters...)
+	for _, f := range config.Filters {
+		filters = append(filters, corefileFilter{ID: f.ID, Path: f.Path(), Enabled: f.Enabled, Contents: f.Contents})
+	}
 	temporaryConfig.Filters = filters
 
 	// run the template
@@ -305,3 +630,153 @@ func assignUniqueFilterID() int64 {
 	nextFilterID += 1
 	return value
 }
+
+var (
+	hostsLineRe = regexp.MustCompile(`^(0\.0\.0\.0|127\.0\.0\.1|::1?)\s+(\S+)`)
+	rpzLineRe   = regexp.MustCompile(`^(\S+?)\.?\s+(\d+\s+)?(IN\s+)?CNAME\s+\.?\s*$`)
+)
+
+// detectFilterFormat looks at the first filterFormatSniffLines non-comment lines of a
+// filter list and guesses whether it's written in hosts-file or RPZ zone syntax,
+// falling back to "adguard" (our native format needs no conversion either way).
+func detectFilterFormat(data []byte) string {
+	checked, hostsVotes, rpzVotes := 0, 0, 0
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		l := bytes.TrimSpace(line)
+		if len(l) == 0 || l[0] == '#' || l[0] == '!' || l[0] == ';' {
+			continue
+		}
+
+		checked++
+		switch {
+		case hostsLineRe.Match(l):
+			hostsVotes++
+		case rpzLineRe.Match(l):
+			rpzVotes++
+		}
+
+		if checked >= filterFormatSniffLines {
+			break
+		}
+	}
+
+	// require a clear majority rather than a unanimous match -- a single odd line (a
+	// stray comment style, a malformed entry) shouldn't be enough to miss an otherwise
+	// obvious hosts/RPZ list
+	switch {
+	case checked == 0:
+		return filterFormatAdGuard
+	case hostsVotes*2 > checked:
+		return filterFormatHosts
+	case rpzVotes*2 > checked:
+		return filterFormatRPZ
+	default:
+		return filterFormatAdGuard
+	}
+}
+
+// hostsSelfReferences are hostnames that conventionally point at loopback/broadcast
+// addresses in hosts files (to satisfy the OS, not to block anything) and must not be
+// turned into blocking rules.
+var hostsSelfReferences = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+}
+
+// hostsToAdGuardRules converts hosts-file style entries ("0.0.0.0 example.com") into
+// AdGuard blocking rules ("||example.com^"), passing comments through untouched and
+// skipping the conventional loopback/broadcast self-references these lists start with.
+func hostsToAdGuardRules(data []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		l := bytes.TrimSpace(line)
+		if len(l) == 0 || l[0] == '#' {
+			out.Write(l)
+			out.WriteByte('\n')
+			continue
+		}
+		m := hostsLineRe.FindSubmatch(l)
+		if m == nil || hostsSelfReferences[string(m[2])] {
+			continue
+		}
+		out.WriteString("||")
+		out.Write(m[2])
+		out.WriteString("^\n")
+	}
+	return out.Bytes()
+}
+
+// rpzToAdGuardRules converts simple RPZ zone records ("example.com CNAME .") into
+// AdGuard blocking rules ("||example.com^").
+func rpzToAdGuardRules(data []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		l := bytes.TrimSpace(line)
+		if len(l) == 0 || l[0] == ';' {
+			continue
+		}
+		m := rpzLineRe.FindSubmatch(l)
+		if m == nil {
+			continue
+		}
+		out.WriteString("||")
+		out.Write(m[1])
+		out.WriteString("^\n")
+	}
+	return out.Bytes()
+}
+
+// countRules counts the non-empty, non-comment lines in a normalized AdGuard rule list.
+func countRules(data []byte) int {
+	count := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		l := bytes.TrimSpace(line)
+		if len(l) == 0 || l[0] == '!' || l[0] == '#' {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// setContents replaces f.Contents with freshly fetched raw data (e.g. after
+// downloading an updated copy of the list) and marks the filter for re-normalization,
+// since the new bytes haven't been converted yet. Anything that overwrites Contents
+// outside of this should call it rather than assigning the field directly, or
+// normalize() will skip the new data thinking it's already been converted.
+func (f *filter) setContents(contents []byte) {
+	f.Contents = contents
+	f.normalized = false
+}
+
+// normalize rewrites f.Contents into canonical AdGuard rule syntax based on f.Format
+// (auto-detecting it first if it's empty or "auto") and updates RulesCount to match the
+// normalized output. It's a no-op if it's already run since the last setContents call,
+// since Contents is AdGuard syntax by then and re-running a hosts/RPZ conversion over
+// it would just discard every rule. Apply calls it through
+// (*configuration).normalizeFilters() before marshaling the YAML and rendering the
+// Corefile; it converts Contents in memory only and does not write the filter's file.
+func (f *filter) normalize() {
+	if f.normalized {
+		return
+	}
+
+	if f.Format == "" || f.Format == filterFormatAuto {
+		f.Format = detectFilterFormat(f.Contents)
+	}
+
+	switch f.Format {
+	case filterFormatHosts:
+		f.Contents = hostsToAdGuardRules(f.Contents)
+	case filterFormatRPZ:
+		f.Contents = rpzToAdGuardRules(f.Contents)
+	}
+
+	f.RulesCount = countRules(f.Contents)
+	f.normalized = true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectFilterFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "hosts",
+			data: "127.0.0.1 localhost\n0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.com\n",
+			want: filterFormatHosts,
+		},
+		{
+			name: "rpz with TTL and class",
+			data: "ads.example.com. 3600 IN CNAME .\ntracker.example.com. 3600 IN CNAME .\n",
+			want: filterFormatRPZ,
+		},
+		{
+			name: "rpz without TTL or class",
+			data: "ads.example.com CNAME .\ntracker.example.com CNAME .\n",
+			want: filterFormatRPZ,
+		},
+		{
+			name: "adguard",
+			data: "||ads.example.com^\n||tracker.example.com^\n",
+			want: filterFormatAdGuard,
+		},
+		{
+			name: "empty",
+			data: "",
+			want: filterFormatAdGuard,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectFilterFormat([]byte(tt.data)); got != tt.want {
+				t.Errorf("detectFilterFormat(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostsToAdGuardRules(t *testing.T) {
+	data := "127.0.0.1 localhost\n" +
+		"0.0.0.0 ads.example.com\n" +
+		"# a comment\n" +
+		"0.0.0.0 broadcasthost\n"
+
+	got := string(hostsToAdGuardRules([]byte(data)))
+	want := "||ads.example.com^\n# a comment\n\n"
+	if got != want {
+		t.Errorf("hostsToAdGuardRules() = %q, want %q", got, want)
+	}
+}
+
+func TestRpzToAdGuardRules(t *testing.T) {
+	data := "ads.example.com. 3600 IN CNAME .\ntracker.example.com CNAME .\n"
+	got := string(rpzToAdGuardRules([]byte(data)))
+	want := "||ads.example.com^\n||tracker.example.com^\n"
+	if got != want {
+		t.Errorf("rpzToAdGuardRules() = %q, want %q", got, want)
+	}
+}
+
+// TestFilterNormalizeIdempotent makes sure a second normalize() call doesn't
+// re-run the hosts/RPZ conversion over already-converted Contents -- that bug
+// shipped once in this series and silently zeroed out the filter.
+func TestFilterNormalizeIdempotent(t *testing.T) {
+	f := filter{Format: filterFormatHosts, Contents: []byte("0.0.0.0 ads.example.com\n")}
+
+	f.normalize()
+	firstPass := append([]byte{}, f.Contents...)
+	if !bytes.Contains(firstPass, []byte("||ads.example.com^")) {
+		t.Fatalf("normalize() didn't convert hosts Contents: %q", firstPass)
+	}
+
+	f.normalize()
+	if !bytes.Equal(f.Contents, firstPass) {
+		t.Errorf("second normalize() call changed Contents: got %q, want %q", f.Contents, firstPass)
+	}
+
+	f.setContents([]byte("0.0.0.0 tracker.example.com\n"))
+	f.normalize()
+	if bytes.Equal(f.Contents, firstPass) {
+		t.Errorf("normalize() after setContents() didn't re-convert the new Contents")
+	}
+	if !bytes.Contains(f.Contents, []byte("||tracker.example.com^")) {
+		t.Errorf("normalize() after setContents() produced unexpected Contents: %q", f.Contents)
+	}
+}